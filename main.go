@@ -8,9 +8,18 @@ import (
 	"flag"
 	"fmt"
 	"github.com/klauspost/compress/zstd"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/proto"
 	"io"
 	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,23 +48,100 @@ type Attribute struct {
 
 type flags struct {
 	matchBy
-	file  string
-	since time.Duration
+	file   string
+	since  time.Duration
+	until  time.Duration
+	follow bool
+	format string
+	output string
+	jobs   int
 }
 
+// followPollInterval is how long run sleeps between retries while
+// waiting for more data to be appended to a followed file.
+const followPollInterval = 500 * time.Millisecond
+
 type matchBy struct {
 	namespace string
 	pod       string
 	container string
+	grep      *regexp.Regexp
+	grepV     *regexp.Regexp
+	attrs     []attrFilter
+}
+
+// attrFilter matches a log record if its attribute named key's string
+// value matches glob (as interpreted by attrGlobMatch).
+type attrFilter struct {
+	key  string
+	glob string
+}
+
+// attrGlobGapFiller stands in for "/" while delegating to path.Match, so
+// "*" matches across "/" the way a user typing -attr image=* expects.
+// Attribute values (image references, URLs, file paths embedded in a
+// message, ...) aren't filesystem paths, so path.Match's "/" separator
+// semantics would otherwise make "*" silently fail to match a value like
+// "registry/image:tag".
+const attrGlobGapFiller = "\x00"
+
+// attrGlobMatch reports whether value matches glob, treating "*" and "?"
+// as ordinary shell-style wildcards with no special meaning for "/".
+func attrGlobMatch(glob, value string) (bool, error) {
+	return path.Match(
+		strings.ReplaceAll(glob, "/", attrGlobGapFiller),
+		strings.ReplaceAll(value, "/", attrGlobGapFiller),
+	)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		if err := runIndexCommand(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var fl flags
 	flag.StringVar(&fl.file, "file", "", "log file path")
 	flag.StringVar(&fl.namespace, "namespace", "", "namespace prefix to filter for")
 	flag.StringVar(&fl.pod, "pod", "", "pod prefix to filter for")
 	flag.StringVar(&fl.container, "container", "", "container prefix to filter for")
 	flag.DurationVar(&fl.since, "since", time.Duration(0), "only return logs newer than a relative duration like 5s, 2m, or 3h")
+	flag.DurationVar(&fl.until, "until", time.Duration(0), "with -follow, stop once this long has elapsed since start")
+	flag.BoolVar(&fl.follow, "follow", false, "keep the file open and tail new chunks as they are written")
+	flag.BoolVar(&fl.follow, "f", false, "shorthand for -follow")
+	flag.StringVar(&fl.format, "format", "auto", "payload format of each decompressed frame: json, proto, or auto")
+	flag.StringVar(&fl.output, "output", "text", "output format: text, json, or logfmt")
+	flag.IntVar(&fl.jobs, "jobs", runtime.NumCPU(), "number of workers decompressing chunks in parallel; 1 runs the original sequential path")
+	flag.Func("grep", "only include records whose message matches this regexp", func(value string) error {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		fl.grep = re
+		return nil
+	})
+	flag.Func("grep-v", "exclude records whose message matches this regexp", func(value string) error {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		fl.grepV = re
+		return nil
+	})
+	flag.Func("attr", "repeatable key=glob filter against arbitrary log record attributes (\"*\" and \"?\" are ordinary wildcards, matching across \"/\" too)", func(value string) error {
+		key, glob, found := strings.Cut(value, "=")
+		if !found {
+			return fmt.Errorf("invalid -attr %q: must be key=glob", value)
+		}
+		if _, err := attrGlobMatch(glob, ""); err != nil {
+			return fmt.Errorf("invalid -attr %q: %v", value, err)
+		}
+		fl.attrs = append(fl.attrs, attrFilter{key: key, glob: glob})
+		return nil
+	})
 
 	flag.Parse()
 	if err := validate(fl); err != nil {
@@ -73,6 +159,19 @@ func validate(fl flags) error {
 	if fl.file == "" {
 		return errors.New("compressed path not provided")
 	}
+	switch fl.format {
+	case "", "auto", "json", "proto":
+	default:
+		return fmt.Errorf("invalid format %q: must be one of json, proto, auto", fl.format)
+	}
+	switch fl.output {
+	case "", "text", "json", "logfmt":
+	default:
+		return fmt.Errorf("invalid output %q: must be one of text, json, logfmt", fl.output)
+	}
+	if fl.jobs < 1 {
+		return fmt.Errorf("invalid jobs %d: must be at least 1", fl.jobs)
+	}
 	return nil
 }
 
@@ -83,80 +182,820 @@ func run(fl flags, out io.Writer) error {
 	}
 	defer compressed.Close()
 
+	decoder, err := newLogDecoder(fl.format)
+	if err != nil {
+		return err
+	}
+
+	write, err := newFormatter(fl.output)
+	if err != nil {
+		return err
+	}
+
+	if fl.since != time.Duration(0) {
+		records, err := loadIndexOrBuild(fl.file, compressed, decoder)
+		if err != nil {
+			return fmt.Errorf("failed to load time-range index: %v", err)
+		}
+
+		fromTimestamp := time.Now().UTC().Add(-1 * fl.since)
+		if err := seekToWindow(compressed, records, fromTimestamp); err != nil {
+			return fmt.Errorf("failed to seek to time window: %v", err)
+		}
+	}
+
+	var untilTimestamp time.Time
+	if fl.until != time.Duration(0) {
+		untilTimestamp = time.Now().UTC().Add(fl.until)
+	}
+
+	// Follow mode's EOF-retry and rotation handling assumes a single
+	// reader advancing through the file, so it always runs the
+	// sequential path below regardless of -jobs.
+	if fl.jobs > 1 && !fl.follow {
+		return runParallel(fl, compressed, decoder, write, untilTimestamp, out)
+	}
+
 	for {
-		logDataJSON, err := decompressChunk(compressed)
+		if fl.follow && !untilTimestamp.IsZero() && time.Now().UTC().After(untilTimestamp) {
+			return nil
+		}
+
+		frame, err := decompressChunk(compressed)
 		if err != nil {
 			if err == io.EOF {
-				break
+				if !fl.follow {
+					break
+				}
+
+				reopened, err := reopenOnRotation(fl.file, compressed)
+				if err != nil {
+					return err
+				}
+				compressed = reopened
+
+				time.Sleep(followPollInterval)
+				continue
 			}
 			return err
 		}
 
-		var logData LogData
-		if err := json.Unmarshal(logDataJSON, &logData); err != nil {
-			return fmt.Errorf("failed to unmarshal a log line: %v", err)
+		logData, err := decoder.decode(frame)
+		if err != nil {
+			return fmt.Errorf("failed to decode a log frame: %v", err)
+		}
+
+		if err := writeLogData(logData, fl, untilTimestamp, write, out); err != nil {
+			return err
 		}
+	}
 
-		for _, resourceLog := range logData.ResourceLogs {
-			for _, scopeLog := range resourceLog.ScopeLogs {
-				for _, logRecord := range scopeLog.LogRecords {
-					message := logMessage(logRecord.Body)
+	return nil
+}
 
-					rawTimestamp := stringAttributeByKey(logRecord.Attributes, "time")
-					timestamp, err := time.Parse(time.RFC3339, rawTimestamp)
-					if err != nil {
-						continue
-					}
+// writeLogData applies the since/until bounds, tag/grep/attr filters, and
+// the chosen output formatter to every log record in logData, in file
+// order. Both the sequential loop in run and runParallel's reorder stage
+// funnel through this so a decoded batch is handled identically either
+// way.
+func writeLogData(logData LogData, fl flags, untilTimestamp time.Time, write formatter, out io.Writer) error {
+	for _, resourceLog := range logData.ResourceLogs {
+		for _, scopeLog := range resourceLog.ScopeLogs {
+			for _, logRecord := range scopeLog.LogRecords {
+				message := logMessage(logRecord.Body)
 
-					if fl.since != time.Duration(0) {
-						fromTimestamp := time.Now().UTC().Add(-1 * fl.since)
-						if timestamp.Before(fromTimestamp) {
-							continue
-						}
-					}
+				rawTimestamp := stringAttributeByKey(logRecord.Attributes, "time")
+				timestamp, err := time.Parse(time.RFC3339, rawTimestamp)
+				if err != nil {
+					continue
+				}
 
-					rawTag := stringAttributeByKey(logRecord.Attributes, "fluent.tag")
-					tag, err := parseFluentTag(rawTag)
-					if err != nil {
+				if fl.since != time.Duration(0) {
+					fromTimestamp := time.Now().UTC().Add(-1 * fl.since)
+					if timestamp.Before(fromTimestamp) {
 						continue
 					}
+				}
 
-					if matches(tag, fl.matchBy) {
-						fmt.Fprintf(out, "%v/%v\t%v\t%v\t%v\n", tag.namespace, tag.pod, tag.container, timestamp, message)
-					}
+				if !untilTimestamp.IsZero() && timestamp.After(untilTimestamp) {
+					continue
+				}
+
+				rawTag := stringAttributeByKey(logRecord.Attributes, "fluent.tag")
+				tag, err := parseFluentTag(rawTag)
+				if err != nil {
+					continue
+				}
+
+				rec := record{
+					ts:      timestamp,
+					tag:     tag,
+					message: message,
+					attrs:   logRecord.Attributes,
+				}
+
+				if !passesFilters(rec, fl.matchBy) {
+					continue
+				}
+
+				if err := write(out, rec); err != nil {
+					return err
 				}
 			}
 		}
 	}
-
 	return nil
 }
 
-func decompressChunk(in io.Reader) ([]byte, error) {
-	sizeBuf := make([]byte, 4)
-	if err := binary.Read(in, binary.BigEndian, &sizeBuf); err != nil {
+// reopenOnRotation detects whether path now refers to a different inode
+// than current (e.g. the producer rotated the file out from under us)
+// and, if so, closes current and reopens path from the start. When path
+// can't be stat'd or reopened, current is returned unchanged so follow
+// mode keeps retrying against it.
+func reopenOnRotation(path string, current *os.File) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return current, nil
+	}
+
+	currentInfo, err := current.Stat()
+	if err != nil {
+		return current, nil
+	}
+
+	if os.SameFile(currentInfo, info) {
+		return current, nil
+	}
+
+	reopened, err := os.Open(path)
+	if err != nil {
+		return current, nil
+	}
+
+	current.Close()
+	return reopened, nil
+}
+
+// decompressChunk reads and decompresses the next length-prefixed zstd
+// frame from in.
+func decompressChunk(in *os.File) ([]byte, error) {
+	payload, err := readChunkPayload(in)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := zstd.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	var decompressedChunk bytes.Buffer
+	if _, err := io.Copy(&decompressedChunk, d); err != nil {
+		return nil, err
+	}
+	return decompressedChunk.Bytes(), nil
+}
+
+// readChunkPayload reads the next length-prefixed frame from in without
+// decompressing it, so the bytes can be handed off to a worker pool. A
+// frame may not be fully written yet when tailing a file that's still
+// being appended to; if the length prefix or payload is only partially
+// available, in is rewound to where the read started and io.EOF is
+// returned so the caller can retry once more data arrives, without
+// losing any bytes in the meantime.
+func readChunkPayload(in *os.File) ([]byte, error) {
+	start, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
 		return nil, err
 	}
 
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(in, sizeBuf); err != nil {
+		return nil, rewindOnShortRead(in, start, err)
+	}
+
 	size := binary.BigEndian.Uint32(sizeBuf)
 	dataBuf := make([]byte, size)
-	if err := binary.Read(in, binary.BigEndian, &dataBuf); err != nil {
+	if _, err := io.ReadFull(in, dataBuf); err != nil {
+		return nil, rewindOnShortRead(in, start, err)
+	}
+
+	return dataBuf, nil
+}
+
+// chunkJob is a single compressed frame read off disk by runParallel's
+// reader goroutine, tagged with its position in the file so results can
+// be reassembled in order after concurrent decompression.
+type chunkJob struct {
+	seq     int
+	payload []byte
+}
+
+// chunkResult is the decoded outcome of a chunkJob.
+type chunkResult struct {
+	seq     int
+	logData LogData
+	err     error
+}
+
+// decodeBufferPool recycles the bytes.Buffer each worker decompresses
+// into, so a long run doesn't allocate a fresh growable buffer per
+// chunk.
+var decodeBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// decodeChunk decompresses payload using a worker-owned, reusable
+// *zstd.Decoder and hands the result to decoder for unmarshaling. The
+// decompressed bytes are copied out of the pooled buffer before it's
+// returned to decodeBufferPool, because both the JSON and protobuf
+// decoders may retain references into the byte slice they're given
+// (e.g. protobuf's unsafe string decoding) past the point where a reused
+// buffer would otherwise be overwritten.
+func decodeChunk(dec *zstd.Decoder, decoder logDecoder, payload []byte) (LogData, error) {
+	if err := dec.Reset(bytes.NewReader(payload)); err != nil {
+		return LogData{}, err
+	}
+
+	buf := decodeBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := io.Copy(buf, dec); err != nil {
+		decodeBufferPool.Put(buf)
+		return LogData{}, err
+	}
+
+	frame := append([]byte(nil), buf.Bytes()...)
+	decodeBufferPool.Put(buf)
+
+	return decoder.decode(frame)
+}
+
+// runParallel is the -jobs>1 counterpart of the sequential loop in run:
+// a reader goroutine only reads length-prefixed frames off disk and
+// hands them to a pool of fl.jobs workers that decompress and decode
+// concurrently, each with its own reusable *zstd.Decoder. On the calling
+// goroutine, a reorder buffer keyed by seq funnels finished batches back
+// through writeLogData in file order, so output is identical to -jobs=1
+// regardless of which worker finishes first.
+func runParallel(fl flags, compressed *os.File, decoder logDecoder, write formatter, untilTimestamp time.Time, out io.Writer) error {
+	// Resolve a -format=auto decoder synchronously against the file's
+	// actual first frame before any worker touches it. Left to
+	// autoLogDecoder's own mutex, the format would instead be decided by
+	// whichever worker happens to decode its chunk first, making output
+	// depend on scheduling rather than file order.
+	firstPayload, err := readChunkPayload(compressed)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	peekDec, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	firstLogData, err := decodeChunk(peekDec, decoder, firstPayload)
+	peekDec.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode a log frame: %v", err)
+	}
+	if err := writeLogData(firstLogData, fl, untilTimestamp, write, out); err != nil {
+		return err
+	}
+
+	jobs := make(chan chunkJob, fl.jobs)
+	results := make(chan chunkResult, fl.jobs)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	signalStop := func() { stopOnce.Do(func() { close(stop) }) }
+
+	var workers sync.WaitGroup
+	workers.Add(fl.jobs)
+	for i := 0; i < fl.jobs; i++ {
+		go func() {
+			defer workers.Done()
+
+			dec, err := zstd.NewReader(nil)
+			if err != nil {
+				results <- chunkResult{err: err}
+				return
+			}
+			defer dec.Close()
+
+			for job := range jobs {
+				logData, err := decodeChunk(dec, decoder, job.payload)
+				results <- chunkResult{seq: job.seq, logData: logData, err: err}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		for seq := 1; ; seq++ {
+			payload, err := readChunkPayload(compressed)
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+			select {
+			case jobs <- chunkJob{seq: seq, payload: payload}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// drainResults lets the reader and any still-running workers finish
+	// and exit (they may be blocked sending to results or jobs) instead
+	// of leaking goroutines blocked forever once this function returns.
+	drainResults := func() {
+		signalStop()
+		for range results {
+		}
+	}
+
+	pending := make(map[int]chunkResult)
+	next := 1
+	for res := range results {
+		if res.err != nil {
+			drainResults()
+			return fmt.Errorf("failed to decode a log frame: %v", res.err)
+		}
+
+		pending[res.seq] = res
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			if err := writeLogData(ready.logData, fl, untilTimestamp, write, out); err != nil {
+				drainResults()
+				return err
+			}
+		}
+	}
+
+	return readErr
+}
+
+// rewindOnShortRead turns a short or empty read at the end of in into a
+// plain io.EOF after rewinding in back to start, so no bytes already
+// read are lost. Any other error is returned unchanged.
+func rewindOnShortRead(in *os.File, start int64, err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, serr := in.Seek(start, io.SeekStart); serr != nil {
+		return serr
+	}
+	return io.EOF
+}
+
+// logDecoder turns a single decompressed frame into a LogData, regardless
+// of whether the frame is OTLP/JSON or OTLP/protobuf on the wire.
+type logDecoder interface {
+	decode(frame []byte) (LogData, error)
+}
+
+// newLogDecoder builds the logDecoder named by format ("json", "proto",
+// or "auto"/""). Auto sniffs the format from the first frame it sees and
+// sticks with that decision for the rest of the file.
+func newLogDecoder(format string) (logDecoder, error) {
+	switch format {
+	case "", "auto":
+		return &autoLogDecoder{}, nil
+	case "json":
+		return jsonLogDecoder{}, nil
+	case "proto":
+		return protoLogDecoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type jsonLogDecoder struct{}
+
+func (jsonLogDecoder) decode(frame []byte) (LogData, error) {
+	var logData LogData
+	if err := json.Unmarshal(frame, &logData); err != nil {
+		return LogData{}, fmt.Errorf("failed to unmarshal a log line: %v", err)
+	}
+	return logData, nil
+}
+
+type protoLogDecoder struct{}
+
+func (protoLogDecoder) decode(frame []byte) (LogData, error) {
+	var data logsv1.LogsData
+	if err := proto.Unmarshal(frame, &data); err != nil {
+		return LogData{}, fmt.Errorf("failed to unmarshal a log line: %v", err)
+	}
+	return logsDataFromProto(&data), nil
+}
+
+// autoLogDecoder sniffs the first byte of the first frame it sees -- '{'
+// means OTLP/JSON, anything else means OTLP/protobuf -- and delegates to
+// that decoder for every subsequent frame in the file. It's shared
+// across runParallel's workers, so resolving the format is guarded by a
+// mutex even though decoding itself (jsonLogDecoder/protoLogDecoder are
+// stateless) needs no further synchronization.
+type autoLogDecoder struct {
+	mu       sync.Mutex
+	resolved logDecoder
+}
+
+func (a *autoLogDecoder) decode(frame []byte) (LogData, error) {
+	a.mu.Lock()
+	if a.resolved == nil {
+		if len(frame) > 0 && frame[0] == '{' {
+			a.resolved = jsonLogDecoder{}
+		} else {
+			a.resolved = protoLogDecoder{}
+		}
+	}
+	resolved := a.resolved
+	a.mu.Unlock()
+
+	return resolved.decode(frame)
+}
+
+// logsDataFromProto maps an OTLP logs.proto message onto the same
+// LogData/Attribute shape the JSON decoder produces, so the fluent-tag
+// parsing, timestamp filtering, and message extraction below are shared
+// between both formats.
+func logsDataFromProto(data *logsv1.LogsData) LogData {
+	var logData LogData
+	for _, rl := range data.ResourceLogs {
+		var resourceLogs ResourceLogs
+		for _, sl := range rl.ScopeLogs {
+			var scopeLogs ScopeLogs
+			for _, lr := range sl.LogRecords {
+				scopeLogs.LogRecords = append(scopeLogs.LogRecords, LogRecords{
+					TimeUnixNano: strconv.FormatUint(lr.TimeUnixNano, 10),
+					Body:         anyValueToMap(lr.Body),
+					Attributes:   attributesFromProto(lr.Attributes),
+				})
+			}
+			resourceLogs.ScopeLogs = append(resourceLogs.ScopeLogs, scopeLogs)
+		}
+		logData.ResourceLogs = append(logData.ResourceLogs, resourceLogs)
+	}
+	return logData
+}
+
+func attributesFromProto(kvs []*commonv1.KeyValue) []Attribute {
+	attrs := make([]Attribute, 0, len(kvs))
+	for _, kv := range kvs {
+		attrs = append(attrs, Attribute{
+			Key:   kv.Key,
+			Value: anyValueToMap(kv.Value),
+		})
+	}
+	return attrs
+}
+
+// anyValueToMap mirrors the shape encoding/json produces for a string
+// OTLP AnyValue ({"stringValue": "..."}), which is what logMessage and
+// stringAttributeByKey already know how to read. Only string values are
+// mapped; any other AnyValue kind becomes nil.
+func anyValueToMap(v *commonv1.AnyValue) map[string]any {
+	if v == nil {
+		return nil
+	}
+	switch val := v.Value.(type) {
+	case *commonv1.AnyValue_StringValue:
+		return map[string]any{"stringValue": val.StringValue}
+	default:
+		return nil
+	}
+}
+
+// indexMagic and indexVersion identify the sidecar time-range index
+// format. Version 2 added an indexHeader fingerprint of the source log
+// file so a stale .idx left over from a rotated or replaced file is
+// detected and rebuilt rather than trusted. The header is followed by
+// fixed-size indexRecordSize records. loadIndex reads only indexVersion
+// and returns an error for an index file of any other version.
+const (
+	indexMagic      = "KCPIDX1"
+	indexVersion    = 2
+	indexRecordSize = 8 + 4 + 8 + 8 // offset, compressedLen, minTime, maxTime
+)
+
+// indexHeader fingerprints the source log file an index was built
+// against, so loadIndexOrBuild can tell a stale index apart from a
+// current one before seekToWindow trusts any of its byte offsets.
+type indexHeader struct {
+	sourceSize    int64
+	sourceModTime int64 // UnixNano
+}
+
+// indexRecord describes a single zstd frame in the compressed log file:
+// where it starts, how long its compressed payload is, and the min/max
+// "time" attribute observed among the log records it decodes to.
+type indexRecord struct {
+	offset        uint64
+	compressedLen uint32
+	minTime       int64 // UnixNano
+	maxTime       int64 // UnixNano
+}
+
+func indexPath(file string) string {
+	return file + ".idx"
+}
+
+func runIndexCommand(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	file := fs.String("file", "", "log file path")
+	format := fs.String("format", "auto", "payload format of each decompressed frame: json, proto, or auto")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("compressed path not provided")
+	}
+
+	decoder, err := newLogDecoder(*format)
+	if err != nil {
+		return err
+	}
+
+	compressed, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+
+	header, err := sourceIndexHeader(compressed)
+	if err != nil {
+		return err
+	}
+
+	records, err := buildIndex(compressed, decoder)
+	if err != nil {
+		return err
+	}
+
+	return writeIndex(indexPath(*file), header, records)
+}
+
+// sourceIndexHeader fingerprints compressed's current size and mtime for
+// storage in (or comparison against) a sidecar index header.
+func sourceIndexHeader(compressed *os.File) (indexHeader, error) {
+	info, err := compressed.Stat()
+	if err != nil {
+		return indexHeader{}, err
+	}
+	return indexHeader{sourceSize: info.Size(), sourceModTime: info.ModTime().UnixNano()}, nil
+}
+
+// loadIndexOrBuild loads the sidecar index for file, rebuilding and
+// persisting it from compressed if it doesn't exist yet or its header no
+// longer matches compressed's current size/mtime -- e.g. because file
+// was rotated or replaced out from under a stale .idx.
+func loadIndexOrBuild(file string, compressed *os.File, decoder logDecoder) ([]indexRecord, error) {
+	path := indexPath(file)
+
+	header, err := sourceIndexHeader(compressed)
+	if err != nil {
 		return nil, err
 	}
 
-	compressedChunk := bytes.NewBuffer(dataBuf)
-	var decompressedChunk bytes.Buffer
+	records, loadedHeader, err := loadIndex(path)
+	if err == nil && loadedHeader == header {
+		return records, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
 
-	d, err := zstd.NewReader(compressedChunk)
+	records, err = buildIndex(compressed, decoder)
 	if err != nil {
 		return nil, err
 	}
-	defer d.Close()
+	if err := writeIndex(path, header, records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
 
-	if _, err := io.Copy(&decompressedChunk, d); err != nil {
+// buildIndex scans compressed from the start, recording the offset,
+// compressed length, and min/max timestamp of every zstd frame. Frames
+// that fail to decode or hold no record with a parseable "time"
+// attribute get no record.
+func buildIndex(compressed *os.File, decoder logDecoder) ([]indexRecord, error) {
+	if _, err := compressed.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
-	return decompressedChunk.Bytes(), nil
+
+	var records []indexRecord
+	for {
+		offset, err := compressed.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		frame, err := decompressChunk(compressed)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		endOffset, err := compressed.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		compressedLen := uint32(endOffset - offset - 4)
+
+		logData, err := decoder.decode(frame)
+		if err != nil {
+			continue
+		}
+
+		minTime, maxTime, ok := logDataTimeRange(logData)
+		if !ok {
+			continue
+		}
+
+		records = append(records, indexRecord{
+			offset:        uint64(offset),
+			compressedLen: compressedLen,
+			minTime:       minTime.UnixNano(),
+			maxTime:       maxTime.UnixNano(),
+		})
+	}
+
+	return records, nil
+}
+
+// logDataTimeRange returns the min and max "time" attribute among all log
+// records decoded from a single decompressed frame.
+func logDataTimeRange(logData LogData) (min, max time.Time, ok bool) {
+	for _, resourceLog := range logData.ResourceLogs {
+		for _, scopeLog := range resourceLog.ScopeLogs {
+			for _, logRecord := range scopeLog.LogRecords {
+				rawTimestamp := stringAttributeByKey(logRecord.Attributes, "time")
+				timestamp, err := time.Parse(time.RFC3339, rawTimestamp)
+				if err != nil {
+					continue
+				}
+
+				if !ok || timestamp.Before(min) {
+					min = timestamp
+				}
+				if !ok || timestamp.After(max) {
+					max = timestamp
+				}
+				ok = true
+			}
+		}
+	}
+
+	return min, max, ok
+}
+
+func writeIndex(path string, header indexHeader, records []indexRecord) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(indexMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(f, binary.BigEndian, uint8(indexVersion)); err != nil {
+		return err
+	}
+	if err := binary.Write(f, binary.BigEndian, header.sourceSize); err != nil {
+		return err
+	}
+	if err := binary.Write(f, binary.BigEndian, header.sourceModTime); err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		if err := binary.Write(f, binary.BigEndian, rec.offset); err != nil {
+			return err
+		}
+		if err := binary.Write(f, binary.BigEndian, rec.compressedLen); err != nil {
+			return err
+		}
+		if err := binary.Write(f, binary.BigEndian, rec.minTime); err != nil {
+			return err
+		}
+		if err := binary.Write(f, binary.BigEndian, rec.maxTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadIndex(path string) ([]indexRecord, indexHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, indexHeader{}, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, indexHeader{}, err
+	}
+	if string(magic) != indexMagic {
+		return nil, indexHeader{}, fmt.Errorf("not a kcp-logs index file")
+	}
+
+	var version uint8
+	if err := binary.Read(f, binary.BigEndian, &version); err != nil {
+		return nil, indexHeader{}, err
+	}
+	if version != indexVersion {
+		return nil, indexHeader{}, fmt.Errorf("unsupported index version %d", version)
+	}
+
+	var header indexHeader
+	if err := binary.Read(f, binary.BigEndian, &header.sourceSize); err != nil {
+		return nil, indexHeader{}, err
+	}
+	if err := binary.Read(f, binary.BigEndian, &header.sourceModTime); err != nil {
+		return nil, indexHeader{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, indexHeader{}, err
+	}
+	headerSize, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, indexHeader{}, err
+	}
+	if remaining := info.Size() - headerSize; remaining%indexRecordSize != 0 {
+		return nil, indexHeader{}, fmt.Errorf("corrupt index: %d trailing bytes do not form whole %d-byte records", remaining, indexRecordSize)
+	}
+
+	var records []indexRecord
+	for {
+		var rec indexRecord
+		if err := binary.Read(f, binary.BigEndian, &rec.offset); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, indexHeader{}, err
+		}
+		if err := binary.Read(f, binary.BigEndian, &rec.compressedLen); err != nil {
+			return nil, indexHeader{}, err
+		}
+		if err := binary.Read(f, binary.BigEndian, &rec.minTime); err != nil {
+			return nil, indexHeader{}, err
+		}
+		if err := binary.Read(f, binary.BigEndian, &rec.maxTime); err != nil {
+			return nil, indexHeader{}, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, header, nil
+}
+
+// seekToWindow positions compressed at the start of the first indexed
+// frame whose time range could contain a record at or after from,
+// letting run skip straight past frames that are entirely too old.
+func seekToWindow(compressed *os.File, records []indexRecord, from time.Time) error {
+	if len(records) == 0 {
+		_, err := compressed.Seek(0, io.SeekStart)
+		return err
+	}
+
+	fromNano := from.UnixNano()
+	idx := sort.Search(len(records), func(i int) bool {
+		return records[i].maxTime >= fromNano
+	})
+
+	var offset int64
+	if idx < len(records) {
+		offset = int64(records[idx].offset)
+	} else {
+		last := records[len(records)-1]
+		offset = int64(last.offset) + 4 + int64(last.compressedLen)
+	}
+
+	_, err := compressed.Seek(offset, io.SeekStart)
+	return err
 }
 
 func logMessage(body map[string]any) string {
@@ -216,3 +1055,101 @@ func matches(tag fluentTag, by matchBy) bool {
 	}
 	return true
 }
+
+// record is a normalized, already-decoded log line: the shape filtering
+// and formatting operate on, independent of the OTLP/JSON or
+// OTLP/protobuf frame it came from.
+type record struct {
+	ts      time.Time
+	tag     fluentTag
+	message string
+	attrs   []Attribute
+}
+
+// passesFilters reports whether rec satisfies every predicate implied by
+// by: the namespace/pod/container prefixes, -grep/-grep-v, and any -attr
+// key=glob filters.
+func passesFilters(rec record, by matchBy) bool {
+	if !matches(rec.tag, by) {
+		return false
+	}
+	if by.grep != nil && !by.grep.MatchString(rec.message) {
+		return false
+	}
+	if by.grepV != nil && by.grepV.MatchString(rec.message) {
+		return false
+	}
+	for _, af := range by.attrs {
+		val := stringAttributeByKey(rec.attrs, af.key)
+		ok, err := attrGlobMatch(af.glob, val)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// formatter writes a single record to out in a particular output format.
+type formatter func(out io.Writer, rec record) error
+
+// newFormatter returns the formatter named by output ("text", "json", or
+// "logfmt"; "" defaults to "text").
+func newFormatter(output string) (formatter, error) {
+	switch output {
+	case "", "text":
+		return formatText, nil
+	case "json":
+		return formatJSON, nil
+	case "logfmt":
+		return formatLogfmt, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", output)
+	}
+}
+
+// formatText preserves the original tab-separated format.
+func formatText(out io.Writer, rec record) error {
+	_, err := fmt.Fprintf(out, "%v/%v\t%v\t%v\t%v\n", rec.tag.namespace, rec.tag.pod, rec.tag.container, rec.ts, rec.message)
+	return err
+}
+
+type jsonRecord struct {
+	Ts        time.Time         `json:"ts"`
+	Namespace string            `json:"ns"`
+	Pod       string            `json:"pod"`
+	Container string            `json:"container"`
+	Message   string            `json:"msg"`
+	Attrs     map[string]string `json:"attrs"`
+}
+
+// formatJSON emits one canonical JSON record per line, suitable for
+// piping into jq.
+func formatJSON(out io.Writer, rec record) error {
+	return json.NewEncoder(out).Encode(jsonRecord{
+		Ts:        rec.ts,
+		Namespace: rec.tag.namespace,
+		Pod:       rec.tag.pod,
+		Container: rec.tag.container,
+		Message:   rec.message,
+		Attrs:     stringAttributes(rec.attrs),
+	})
+}
+
+// formatLogfmt emits a logfmt line (key=value pairs).
+func formatLogfmt(out io.Writer, rec record) error {
+	_, err := fmt.Fprintf(out, "ts=%s ns=%s pod=%s container=%s msg=%q\n",
+		rec.ts.Format(time.RFC3339Nano), rec.tag.namespace, rec.tag.pod, rec.tag.container, rec.message)
+	return err
+}
+
+// stringAttributes flattens attrs' string values into a plain map for
+// formats (JSON today) that need to render them as a nested object.
+func stringAttributes(attrs []Attribute) map[string]string {
+	out := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		if val, ok := attr.Value["stringValue"].(string); ok {
+			out[attr.Key] = val
+		}
+	}
+	return out
+}
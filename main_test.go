@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	header := indexHeader{sourceSize: 4096, sourceModTime: 1700000000}
+	records := []indexRecord{
+		{offset: 0, compressedLen: 120, minTime: 1000, maxTime: 2000},
+		{offset: 124, compressedLen: 80, minTime: 2500, maxTime: 3000},
+	}
+
+	path := filepath.Join(t.TempDir(), "chunk.log.idx")
+	if err := writeIndex(path, header, records); err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+
+	gotRecords, gotHeader, err := loadIndex(path)
+	if err != nil {
+		t.Fatalf("loadIndex: %v", err)
+	}
+	if !reflect.DeepEqual(gotRecords, records) {
+		t.Fatalf("loadIndex round-trip mismatch: got %+v, want %+v", gotRecords, records)
+	}
+	if gotHeader != header {
+		t.Fatalf("loadIndex header round-trip mismatch: got %+v, want %+v", gotHeader, header)
+	}
+}
+
+func TestLoadIndexRejectsTruncatedFile(t *testing.T) {
+	header := indexHeader{sourceSize: 4096, sourceModTime: 1700000000}
+	records := []indexRecord{{offset: 0, compressedLen: 10, minTime: 1, maxTime: 2}}
+
+	path := filepath.Join(t.TempDir(), "chunk.log.idx")
+	if err := writeIndex(path, header, records); err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	if _, _, err := loadIndex(path); err == nil {
+		t.Fatal("loadIndex: expected an error for a truncated index file, got nil")
+	}
+}
+
+// TestLoadIndexOrBuildRebuildsStaleIndex guards the rotation scenario:
+// an index built over one version of a log file must not be trusted
+// once the file at that path has been replaced or truncated-and-rewritten
+// with different contents, even though the stale .idx still parses.
+func TestLoadIndexOrBuildRebuildsStaleIndex(t *testing.T) {
+	const tag = "kube.var.log.containers.my-pod_my-ns_my-container-deadbeef.log"
+	decoder, err := newLogDecoder("json")
+	if err != nil {
+		t.Fatalf("newLogDecoder: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "chunk.log")
+	original := []LogData{
+		testLogRecord(tag, time.Unix(1700000000, 0).UTC().Format(time.RFC3339), "old 0"),
+		testLogRecord(tag, time.Unix(1700000010, 0).UTC().Format(time.RFC3339), "old 1"),
+	}
+	writeChunkFile(t, path, original)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := loadIndexOrBuild(path, f, decoder); err != nil {
+		t.Fatalf("loadIndexOrBuild (initial): %v", err)
+	}
+	f.Close()
+
+	// Simulate rotation: the file at path is replaced with different,
+	// shorter contents, but the sidecar index from the old contents is
+	// left behind.
+	replacement := []LogData{
+		testLogRecord(tag, time.Unix(1700000100, 0).UTC().Format(time.RFC3339), "new 0"),
+	}
+	writeChunkFile(t, path, replacement)
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	records, err := loadIndexOrBuild(path, f, decoder)
+	if err != nil {
+		t.Fatalf("loadIndexOrBuild (after rotation): %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("loadIndexOrBuild after rotation: got %d records, want 1 (rebuilt from the replaced file)", len(records))
+	}
+	if records[0].minTime != time.Unix(1700000100, 0).UTC().UnixNano() {
+		t.Fatalf("loadIndexOrBuild after rotation: got a record from the stale index, not the replaced file")
+	}
+}
+
+func TestSeekToWindowEdges(t *testing.T) {
+	t.Run("empty index seeks to the start of the file", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "chunk")
+		if err != nil {
+			t.Fatalf("CreateTemp: %v", err)
+		}
+		defer f.Close()
+
+		if _, err := f.Write([]byte("xxxxx")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if _, err := f.Seek(3, io.SeekStart); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+
+		if err := seekToWindow(f, nil, time.Unix(0, 0)); err != nil {
+			t.Fatalf("seekToWindow: %v", err)
+		}
+		if pos, err := f.Seek(0, io.SeekCurrent); err != nil {
+			t.Fatalf("Seek: %v", err)
+		} else if pos != 0 {
+			t.Fatalf("seekToWindow with an empty index: got offset %d, want 0", pos)
+		}
+	})
+
+	t.Run("from past the last record seeks past the end of the indexed frames", func(t *testing.T) {
+		records := []indexRecord{
+			{offset: 0, compressedLen: 10, minTime: 0, maxTime: 100},
+			{offset: 14, compressedLen: 20, minTime: 100, maxTime: 200},
+		}
+
+		f, err := os.CreateTemp(t.TempDir(), "chunk")
+		if err != nil {
+			t.Fatalf("CreateTemp: %v", err)
+		}
+		defer f.Close()
+
+		if err := seekToWindow(f, records, time.Unix(0, 1000)); err != nil {
+			t.Fatalf("seekToWindow: %v", err)
+		}
+		want := int64(records[1].offset) + 4 + int64(records[1].compressedLen)
+		if pos, err := f.Seek(0, io.SeekCurrent); err != nil {
+			t.Fatalf("Seek: %v", err)
+		} else if pos != want {
+			t.Fatalf("seekToWindow past the last record: got offset %d, want %d", pos, want)
+		}
+	})
+}
+
+// testLogRecord builds a minimal OTLP-JSON-shaped LogData with a single
+// record carrying the "time" and "fluent.tag" attributes writeLogData
+// requires to keep a record.
+func testLogRecord(tag, ts, message string) LogData {
+	return LogData{
+		ResourceLogs: []ResourceLogs{{
+			ScopeLogs: []ScopeLogs{{
+				LogRecords: []LogRecords{{
+					Body: map[string]any{"stringValue": message},
+					Attributes: []Attribute{
+						{Key: "time", Value: map[string]any{"stringValue": ts}},
+						{Key: "fluent.tag", Value: map[string]any{"stringValue": tag}},
+					},
+				}},
+			}},
+		}},
+	}
+}
+
+// writeChunkFile writes frames to path in the tool's on-disk format: each
+// frame JSON-marshaled, zstd-compressed, and prefixed with its compressed
+// length as a big-endian uint32.
+func writeChunkFile(t *testing.T, path string, frames []LogData) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter: %v", err)
+	}
+	defer enc.Close()
+
+	for _, frame := range frames {
+		raw, err := json.Marshal(frame)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		compressed := enc.EncodeAll(raw, nil)
+
+		var sizeBuf [4]byte
+		binary.BigEndian.PutUint32(sizeBuf[:], uint32(len(compressed)))
+		if _, err := f.Write(sizeBuf[:]); err != nil {
+			t.Fatalf("write length prefix: %v", err)
+		}
+		if _, err := f.Write(compressed); err != nil {
+			t.Fatalf("write payload: %v", err)
+		}
+	}
+}
+
+// TestRunParallelMatchesSequentialOutput guards the ordering guarantee
+// runParallel's reorder buffer is supposed to provide: run with -jobs>1
+// must emit records in the same file order as the -jobs=1 path, not in
+// whatever order workers happen to finish decompressing. Run with
+// -race to also catch data races in the worker pool.
+func TestRunParallelMatchesSequentialOutput(t *testing.T) {
+	const tag = "kube.var.log.containers.my-pod_my-ns_my-container-deadbeef.log"
+
+	var frames []LogData
+	for i := 0; i < 20; i++ {
+		ts := time.Unix(1700000000+int64(i), 0).UTC().Format(time.RFC3339)
+		frames = append(frames, testLogRecord(tag, ts, fmt.Sprintf("message %d", i)))
+	}
+
+	path := filepath.Join(t.TempDir(), "chunk.log")
+	writeChunkFile(t, path, frames)
+
+	var sequential bytes.Buffer
+	if err := run(flags{file: path, jobs: 1}, &sequential); err != nil {
+		t.Fatalf("run(jobs=1): %v", err)
+	}
+
+	var parallel bytes.Buffer
+	if err := run(flags{file: path, jobs: 4}, &parallel); err != nil {
+		t.Fatalf("run(jobs=4): %v", err)
+	}
+
+	if sequential.String() != parallel.String() {
+		t.Fatalf("jobs=1 and jobs=4 output differ:\nsequential:\n%s\nparallel:\n%s", sequential.String(), parallel.String())
+	}
+}
+
+func TestReopenOnRotationDetectsInodeChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chunk.log")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	current, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Simulate rotation: the producer replaces the file at path with a
+	// new inode while current still holds the old one open.
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("new"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	reopened, err := reopenOnRotation(path, current)
+	if err != nil {
+		t.Fatalf("reopenOnRotation: %v", err)
+	}
+	defer reopened.Close()
+
+	if reopened == current {
+		t.Fatal("reopenOnRotation: expected a new file handle after rotation, got the same one")
+	}
+	got, err := io.ReadAll(reopened)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "new" {
+		t.Fatalf("reopenOnRotation: got content %q, want %q", got, "new")
+	}
+}
+
+func TestReopenOnRotationKeepsSameHandleWithoutRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chunk.log")
+	if err := os.WriteFile(path, []byte("unchanged"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	current, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer current.Close()
+
+	reopened, err := reopenOnRotation(path, current)
+	if err != nil {
+		t.Fatalf("reopenOnRotation: %v", err)
+	}
+	if reopened != current {
+		t.Fatal("reopenOnRotation: expected the same handle back when the file wasn't rotated")
+	}
+}
+
+// TestReadChunkPayloadRewindsOnPartialFrame covers decompressChunk's
+// resilience to a frame being only partially written, which -follow
+// relies on to avoid losing bytes while tailing a file still being
+// appended to.
+func TestReadChunkPayloadRewindsOnPartialFrame(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chunk.log")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	// Only the 4-byte length prefix has landed on disk so far, claiming
+	// a 10-byte payload that hasn't been written yet.
+	var sizeBuf [4]byte
+	binary.BigEndian.PutUint32(sizeBuf[:], 10)
+	if _, err := f.Write(sizeBuf[:]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	if _, err := readChunkPayload(f); err != io.EOF {
+		t.Fatalf("readChunkPayload on a partial frame: got err %v, want io.EOF", err)
+	}
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil {
+		t.Fatalf("Seek: %v", err)
+	} else if pos != 0 {
+		t.Fatalf("readChunkPayload on a partial frame: left the file at offset %d, want 0 (rewound so no bytes are lost)", pos)
+	}
+
+	// The rest of the payload arrives; the retried read must now
+	// succeed and return the whole payload, not just what's new.
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, err := f.Write(bytes.Repeat([]byte{0xAB}, 10)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	payload, err := readChunkPayload(f)
+	if err != nil {
+		t.Fatalf("readChunkPayload once the frame is complete: %v", err)
+	}
+	if len(payload) != 10 {
+		t.Fatalf("readChunkPayload: got %d bytes, want 10", len(payload))
+	}
+}
+
+// TestRunFollowStopsAtUntilEvenWithoutEOF covers the fix in 15d166c:
+// -until must bound follow mode even when the file never produces an
+// io.EOF gap for the loop to notice the deadline in.
+func TestRunFollowStopsAtUntilEvenWithoutEOF(t *testing.T) {
+	const tag = "kube.var.log.containers.my-pod_my-ns_my-container-deadbeef.log"
+
+	path := filepath.Join(t.TempDir(), "chunk.log")
+	writeChunkFile(t, path, []LogData{
+		testLogRecord(tag, time.Now().UTC().Format(time.RFC3339), "hello"),
+	})
+
+	var out bytes.Buffer
+	fl := flags{file: path, jobs: 1, follow: true, until: -time.Second}
+	done := make(chan error, 1)
+	go func() { done <- run(fl, &out) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run with -follow -until in the past did not return; -until is not bounding follow mode")
+	}
+}
+
+// TestProtoLogDecoderMapsAttributesAndBody covers logsDataFromProto's
+// mapping from OTLP/protobuf onto the Attribute/LogRecords shape the
+// JSON decoder produces, which the fluent-tag, timestamp, and message
+// logic in writeLogData assumes regardless of which wire format was
+// actually decoded.
+func TestProtoLogDecoderMapsAttributesAndBody(t *testing.T) {
+	const tag = "kube.var.log.containers.my-pod_my-ns_my-container-deadbeef.log"
+	const ts = "2026-01-02T15:04:05Z"
+
+	data := &logsv1.LogsData{
+		ResourceLogs: []*logsv1.ResourceLogs{{
+			ScopeLogs: []*logsv1.ScopeLogs{{
+				LogRecords: []*logsv1.LogRecord{{
+					Body: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: "hello from protobuf"}},
+					Attributes: []*commonv1.KeyValue{
+						{Key: "time", Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: ts}}},
+						{Key: "fluent.tag", Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: tag}}},
+					},
+				}},
+			}},
+		}},
+	}
+
+	raw, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+
+	logData, err := (protoLogDecoder{}).decode(raw)
+	if err != nil {
+		t.Fatalf("protoLogDecoder.decode: %v", err)
+	}
+	if len(logData.ResourceLogs) != 1 || len(logData.ResourceLogs[0].ScopeLogs) != 1 || len(logData.ResourceLogs[0].ScopeLogs[0].LogRecords) != 1 {
+		t.Fatalf("protoLogDecoder.decode: unexpected shape: %+v", logData)
+	}
+	record := logData.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+
+	if got := logMessage(record.Body); got != "hello from protobuf" {
+		t.Fatalf("logMessage: got %q, want %q", got, "hello from protobuf")
+	}
+	if got := stringAttributeByKey(record.Attributes, "time"); got != ts {
+		t.Fatalf("stringAttributeByKey(time): got %q, want %q", got, ts)
+	}
+
+	rawTag := stringAttributeByKey(record.Attributes, "fluent.tag")
+	if _, err := parseFluentTag(rawTag); err != nil {
+		t.Fatalf("parseFluentTag(%q): %v", rawTag, err)
+	}
+}
+
+// TestAutoLogDecoderSniffsProtobufWhenNotJSON covers autoLogDecoder's
+// sniff: a frame whose first byte isn't '{' must resolve to the proto
+// decoder, not the JSON one.
+func TestAutoLogDecoderSniffsProtobufWhenNotJSON(t *testing.T) {
+	data := &logsv1.LogsData{ResourceLogs: []*logsv1.ResourceLogs{{}}}
+	raw, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	if len(raw) > 0 && raw[0] == '{' {
+		t.Fatalf("test fixture is ambiguous: marshaled protobuf happens to start with '{'")
+	}
+
+	auto := &autoLogDecoder{}
+	if _, err := auto.decode(raw); err != nil {
+		t.Fatalf("autoLogDecoder.decode: %v", err)
+	}
+	if _, ok := auto.resolved.(protoLogDecoder); !ok {
+		t.Fatalf("autoLogDecoder: resolved to %T, want protoLogDecoder", auto.resolved)
+	}
+}
+
+// TestPassesFilters is a table-driven check of -grep/-grep-v/-attr,
+// including the "*" must match across "/" case that attrGlobMatch fixes.
+func TestPassesFilters(t *testing.T) {
+	rec := record{
+		ts:      time.Unix(1700000000, 0).UTC(),
+		tag:     fluentTag{namespace: "my-ns", pod: "my-pod", container: "my-container"},
+		message: "connecting to registry/image:tag",
+		attrs: []Attribute{
+			{Key: "image", Value: map[string]any{"stringValue": "registry/image:tag"}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		by   matchBy
+		want bool
+	}{
+		{"no filters", matchBy{}, true},
+		{"namespace prefix matches", matchBy{namespace: "my-"}, true},
+		{"namespace prefix mismatches", matchBy{namespace: "other"}, false},
+		{"grep matches the message", matchBy{grep: regexp.MustCompile("registry")}, true},
+		{"grep mismatches the message", matchBy{grep: regexp.MustCompile("nope")}, false},
+		{"grep-v excludes a match", matchBy{grepV: regexp.MustCompile("registry")}, false},
+		{"grep-v keeps a non-match", matchBy{grepV: regexp.MustCompile("nope")}, true},
+		{"attr glob matches across /", matchBy{attrs: []attrFilter{{key: "image", glob: "*"}}}, true},
+		{"attr glob matches a specific value across /", matchBy{attrs: []attrFilter{{key: "image", glob: "registry/*"}}}, true},
+		{"attr glob mismatches", matchBy{attrs: []attrFilter{{key: "image", glob: "other/*"}}}, false},
+		{"attr key missing from the record", matchBy{attrs: []attrFilter{{key: "missing", glob: "something"}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := passesFilters(rec, tt.by); got != tt.want {
+				t.Fatalf("passesFilters: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFormatters checks the text/json/logfmt formatters newFormatter
+// dispatches to, and that newFormatter rejects an unknown output format.
+func TestFormatters(t *testing.T) {
+	rec := record{
+		ts:      time.Unix(1700000000, 0).UTC(),
+		tag:     fluentTag{namespace: "my-ns", pod: "my-pod", container: "my-container"},
+		message: "hello world",
+		attrs: []Attribute{
+			{Key: "image", Value: map[string]any{"stringValue": "registry/image:tag"}},
+		},
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := formatText(&buf, rec); err != nil {
+			t.Fatalf("formatText: %v", err)
+		}
+		want := fmt.Sprintf("%v/%v\t%v\t%v\t%v\n", rec.tag.namespace, rec.tag.pod, rec.tag.container, rec.ts, rec.message)
+		if buf.String() != want {
+			t.Fatalf("formatText: got %q, want %q", buf.String(), want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := formatJSON(&buf, rec); err != nil {
+			t.Fatalf("formatJSON: %v", err)
+		}
+
+		var got jsonRecord
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if got.Namespace != "my-ns" || got.Pod != "my-pod" || got.Container != "my-container" || got.Message != "hello world" {
+			t.Fatalf("formatJSON: got %+v", got)
+		}
+		if got.Attrs["image"] != "registry/image:tag" {
+			t.Fatalf("formatJSON: attrs = %+v, want image=registry/image:tag", got.Attrs)
+		}
+	})
+
+	t.Run("logfmt", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := formatLogfmt(&buf, rec); err != nil {
+			t.Fatalf("formatLogfmt: %v", err)
+		}
+		got := buf.String()
+		for _, want := range []string{"ns=my-ns", "pod=my-pod", "container=my-container", `msg="hello world"`} {
+			if !strings.Contains(got, want) {
+				t.Fatalf("formatLogfmt: got %q, missing %q", got, want)
+			}
+		}
+	})
+
+	t.Run("unknown output format is rejected", func(t *testing.T) {
+		if _, err := newFormatter("xml"); err == nil {
+			t.Fatal("newFormatter(\"xml\"): expected an error, got nil")
+		}
+	})
+}